@@ -0,0 +1,122 @@
+package netsync
+
+import (
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+)
+
+const (
+	// announceWindow is how long the fetcher waits after the first
+	// announcement of a hash before picking an announcer to fetch it from,
+	// giving other peers a chance to relay the same block first.
+	announceWindow = 500 * time.Millisecond
+
+	// fetchTimeout is how long the fetcher waits for the chosen peer to
+	// deliver the merkle block before failing over to the next announcer.
+	fetchTimeout = 10 * time.Second
+)
+
+// pendingFetch tracks one in-flight single-block fetch: the peers that
+// announced it, oldest first, and which one (if any) we're currently
+// waiting on.
+type pendingFetch struct {
+	announcers []*peer.Peer
+	requested  *peer.Peer
+}
+
+// BlockFetcher handles single-block inv announcements once the wallet has
+// finished its initial sync, inspired by Bytom's netsync/block_fetcher.go.
+// Unlike the bulk sync-manager download queue it's built around the common
+// case of a lone new tip: it waits briefly to see how many peers relay the
+// same announcement, requests it from the first one, and fails over to the
+// next announcer on timeout instead of giving up.
+type BlockFetcher struct {
+	mu      sync.Mutex
+	pending map[chainhash.Hash]*pendingFetch
+
+	request func(p *peer.Peer, hash chainhash.Hash)
+	expired func(hash chainhash.Hash)
+}
+
+func newBlockFetcher(request func(p *peer.Peer, hash chainhash.Hash), expired func(hash chainhash.Hash)) *BlockFetcher {
+	return &BlockFetcher{
+		pending: make(map[chainhash.Hash]*pendingFetch),
+		request: request,
+		expired: expired,
+	}
+}
+
+// Announce records that p announced hash. The first announcement for a
+// hash starts the arrival window; once it elapses the fetcher requests the
+// block from the first peer that announced it.
+func (f *BlockFetcher) Announce(p *peer.Peer, hash chainhash.Hash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if pf, ok := f.pending[hash]; ok {
+		pf.announcers = append(pf.announcers, p)
+		return
+	}
+	f.pending[hash] = &pendingFetch{announcers: []*peer.Peer{p}}
+	time.AfterFunc(announceWindow, func() { f.startFetch(hash) })
+}
+
+// startFetch requests hash from the first peer that announced it, unless
+// it's already been delivered or requested.
+func (f *BlockFetcher) startFetch(hash chainhash.Hash) {
+	f.mu.Lock()
+	pf, ok := f.pending[hash]
+	if !ok || pf.requested != nil {
+		f.mu.Unlock()
+		return
+	}
+	p := pf.announcers[0]
+	pf.requested = p
+	f.mu.Unlock()
+
+	f.request(p, hash)
+	time.AfterFunc(fetchTimeout, func() { f.onTimeout(hash, p) })
+}
+
+// onTimeout drops p from the announcer list and retries with the next
+// announcer, if there is one. If every announcer has timed out the fetch is
+// abandoned and expired is called.
+func (f *BlockFetcher) onTimeout(hash chainhash.Hash, p *peer.Peer) {
+	f.mu.Lock()
+	pf, ok := f.pending[hash]
+	if !ok || pf.requested == nil || pf.requested.ID() != p.ID() {
+		f.mu.Unlock()
+		return
+	}
+	pf.announcers = pf.announcers[1:]
+	pf.requested = nil
+	if len(pf.announcers) == 0 {
+		delete(f.pending, hash)
+		f.mu.Unlock()
+		f.expired(hash)
+		return
+	}
+	f.mu.Unlock()
+	f.startFetch(hash)
+}
+
+// Delivered tells the fetcher hash arrived successfully, clearing it from
+// the pending set so no failover request is sent for it. It's a no-op if
+// hash isn't pending. A later announcement of hash starts a new fetch.
+func (f *BlockFetcher) Delivered(hash chainhash.Hash) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.pending, hash)
+}
+
+// IsPending reports whether hash has been announced to this fetcher and is
+// neither delivered nor expired yet. The sync manager uses it to tell
+// fetcher blocks apart from its bulk download queue.
+func (f *BlockFetcher) IsPending(hash chainhash.Hash) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.pending[hash]
+	return ok
+}
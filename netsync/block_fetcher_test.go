@@ -0,0 +1,157 @@
+package netsync
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+)
+
+func testPeer(t *testing.T, addr string) *peer.Peer {
+	t.Helper()
+	p, err := peer.NewOutboundPeer(&peer.Config{}, addr)
+	if err != nil {
+		t.Fatalf("peer.NewOutboundPeer(%q) error: %v", addr, err)
+	}
+	return p
+}
+
+// TestBlockFetcherFailsOverToNextAnnouncer checks that when the chosen
+// announcer times out, the fetcher retries with the next peer that
+// announced the same block rather than giving up immediately.
+func TestBlockFetcherFailsOverToNextAnnouncer(t *testing.T) {
+	p1 := testPeer(t, "127.0.0.1:8333")
+	p2 := testPeer(t, "127.0.0.1:8334")
+	hash := hashOf(1)
+
+	var mu sync.Mutex
+	// Compare peers by pointer: peers that never completed a version
+	// handshake all report ID 0.
+	var requestedFrom []*peer.Peer
+	var expiredCalled bool
+
+	f := newBlockFetcher(
+		func(p *peer.Peer, h chainhash.Hash) {
+			mu.Lock()
+			requestedFrom = append(requestedFrom, p)
+			mu.Unlock()
+		},
+		func(h chainhash.Hash) {
+			mu.Lock()
+			expiredCalled = true
+			mu.Unlock()
+		},
+	)
+
+	f.Announce(p1, hash)
+	f.Announce(p2, hash)
+
+	// Skip the arrival window and timeout by driving the internal state
+	// machine directly instead of sleeping for real timers.
+	f.startFetch(hash)
+	f.onTimeout(hash, p1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requestedFrom) != 2 || requestedFrom[0] != p1 || requestedFrom[1] != p2 {
+		t.Fatalf("requestedFrom = %v, want [p1 p2]", requestedFrom)
+	}
+	if expiredCalled {
+		t.Fatal("expired should not be called while another announcer remains")
+	}
+	if !f.IsPending(hash) {
+		t.Fatal("IsPending(hash) = false, want true while the failover request is outstanding")
+	}
+}
+
+// TestBlockFetcherExpiresAfterAllAnnouncersTimeOut checks that once every
+// announcer of a hash has timed out, the fetch is abandoned.
+func TestBlockFetcherExpiresAfterAllAnnouncersTimeOut(t *testing.T) {
+	p1 := testPeer(t, "127.0.0.1:8333")
+	hash := hashOf(2)
+
+	var mu sync.Mutex
+	expired := false
+
+	f := newBlockFetcher(
+		func(p *peer.Peer, h chainhash.Hash) {},
+		func(h chainhash.Hash) {
+			mu.Lock()
+			expired = true
+			mu.Unlock()
+		},
+	)
+
+	f.Announce(p1, hash)
+	f.startFetch(hash)
+	f.onTimeout(hash, p1)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !expired {
+		t.Fatal("expired was not called after the only announcer timed out")
+	}
+	if f.IsPending(hash) {
+		t.Fatal("IsPending(hash) = true after the fetch expired")
+	}
+}
+
+// TestBlockFetcherDeliveredClearsPending checks that a successful delivery
+// clears the hash from the pending set.
+func TestBlockFetcherDeliveredClearsPending(t *testing.T) {
+	p1 := testPeer(t, "127.0.0.1:8333")
+	hash := hashOf(3)
+
+	f := newBlockFetcher(
+		func(p *peer.Peer, h chainhash.Hash) {},
+		func(h chainhash.Hash) {},
+	)
+
+	f.Announce(p1, hash)
+	if !f.IsPending(hash) {
+		t.Fatal("IsPending(hash) = false right after Announce")
+	}
+	f.Delivered(hash)
+	if f.IsPending(hash) {
+		t.Fatal("IsPending(hash) = true after Delivered")
+	}
+}
+
+// TestBlockFetcherAnnounceWindow checks that Announce doesn't request the
+// block immediately - it waits for the arrival window so other announcers
+// have a chance to show up first.
+func TestBlockFetcherAnnounceWindow(t *testing.T) {
+	p1 := testPeer(t, "127.0.0.1:8333")
+	hash := hashOf(4)
+
+	var mu sync.Mutex
+	requested := false
+
+	f := newBlockFetcher(
+		func(p *peer.Peer, h chainhash.Hash) {
+			mu.Lock()
+			requested = true
+			mu.Unlock()
+		},
+		func(h chainhash.Hash) {},
+	)
+
+	f.Announce(p1, hash)
+
+	mu.Lock()
+	got := requested
+	mu.Unlock()
+	if got {
+		t.Fatal("request fired before the arrival window elapsed")
+	}
+
+	time.Sleep(announceWindow + 200*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !requested {
+		t.Fatal("request was never fired after the arrival window elapsed")
+	}
+}
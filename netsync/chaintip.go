@@ -0,0 +1,34 @@
+package netsync
+
+import (
+	"sync"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// chainTipBroadcaster fans newly committed tips out to anyone watching via
+// SubscribeChainTip. Sends are non-blocking: a subscriber that isn't
+// keeping up misses a tip rather than stalling the event loop.
+type chainTipBroadcaster struct {
+	mu   sync.Mutex
+	subs []chan wire.BlockHeader
+}
+
+func (b *chainTipBroadcaster) Subscribe() <-chan wire.BlockHeader {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ch := make(chan wire.BlockHeader, 1)
+	b.subs = append(b.subs, ch)
+	return ch
+}
+
+func (b *chainTipBroadcaster) Publish(header wire.BlockHeader) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- header:
+		default:
+		}
+	}
+}
@@ -0,0 +1,448 @@
+package netsync
+
+import (
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// handleNewPeer is called when a new peer is connected. It starts tracking
+// the peer's score, and if we don't have a sync peer yet its BestPeer score
+// is used to pick (or confirm) one.
+func (m *SyncManager) handleNewPeer(p *peer.Peer) {
+	m.peerScores.Add(p)
+	if m.chain.ChainState() != Syncing {
+		return
+	}
+	if m.syncPeer == nil {
+		m.trySwitchSyncPeer()
+	}
+	// Give the new peer work immediately rather than leaving it idle until
+	// an unrelated timeout or disconnect happens to call this again.
+	m.startBlockDownload()
+}
+
+// handleDonePeer is called when a peer disconnects. Any blocks it had
+// outstanding are reassigned to the next available peer, and a new sync
+// peer is picked if it was the one we were syncing against.
+func (m *SyncManager) handleDonePeer(p *peer.Peer) {
+	m.peerScores.Remove(p)
+	var stranded []chainhash.Hash
+	m.requestedBlocks.ForEach(func(hash chainhash.Hash, value interface{}) {
+		if value.(*peer.Peer).ID() == p.ID() {
+			stranded = append(stranded, hash)
+		}
+	})
+	for _, hash := range stranded {
+		m.requestedBlocks.Remove(hash)
+		m.downloadQueue = append(m.downloadQueue, hash)
+	}
+	if m.syncPeer != nil && m.syncPeer.ID() == p.ID() {
+		m.syncPeer = nil
+		m.trySwitchSyncPeer()
+		return
+	}
+	if m.chain.ChainState() == Syncing {
+		m.startBlockDownload()
+	}
+}
+
+// trySwitchSyncPeer promotes the best-scoring eligible peer to sync peer,
+// demoting whoever we were syncing against. It's a no-op if there's no
+// eligible peer, or if the best one is already our sync peer.
+func (m *SyncManager) trySwitchSyncPeer() {
+	best := m.BestPeer()
+	if best == nil {
+		return
+	}
+	if m.syncPeer != nil && best.Peer().ID() == m.syncPeer.ID() {
+		return
+	}
+	m.syncPeer = best.Peer()
+	m.startHeaderSync(m.syncPeer)
+}
+
+// startHeaderSync drives phase one of an initial sync: pulling headers from
+// p in batches via getheaders. Headers are validated and committed to the
+// chain as they arrive but no merkle blocks are requested until the peer
+// has no more headers for us.
+func (m *SyncManager) startHeaderSync(p *peer.Peer) {
+	if m.chain.ChainState() != Syncing {
+		return
+	}
+	height := m.chain.Height()
+	if height >= uint32(p.LastBlock()) {
+		if !m.peerManager.CheckForMoreBlocks(height) {
+			// Don't just take p's word for it - a peer that's stuck or
+			// lying about its height would otherwise stall the sync here.
+			if best := m.BestPeer(); best != nil && best.Peer().ID() != p.ID() {
+				log.Infof("Peer%d appears to be out of headers; trying Peer%d instead", p.ID(), best.Peer().ID())
+				m.syncPeer = best.Peer()
+				m.startHeaderSync(m.syncPeer)
+				return
+			}
+			log.Info("Header sync complete, fetching merkle blocks")
+			m.startBlockDownload()
+			return
+		}
+	}
+	gHeaders := wire.NewMsgGetHeaders()
+	gHeaders.BlockLocatorHashes = m.chain.GetBlockLocatorHashes()
+	gHeaders.HashStop = *maxHash
+	p.QueueMessage(gHeaders, nil)
+}
+
+// handleHeaders processes a phase-one response, committing each header to
+// the chain and queuing its hash for the merkle block fetch in phase two.
+func (m *SyncManager) handleHeaders(p *peer.Peer, msg *wire.MsgHeaders) {
+	for _, hdr := range msg.Headers {
+		newBlock, reorgHeight, _, err := m.chain.CommitHeader(*hdr)
+		if err != nil {
+			log.Warning(err)
+			continue
+		}
+		if !newBlock {
+			continue
+		}
+		if reorgHeight != nil {
+			m.handleReorg(p, *reorgHeight)
+			return
+		}
+		m.downloadQueue = append(m.downloadQueue, hdr.BlockHash())
+	}
+	if len(msg.Headers) < wire.MaxBlockHeadersPerMsg {
+		m.startHeaderSync(p)
+		return
+	}
+	gHeaders := wire.NewMsgGetHeaders()
+	gHeaders.BlockLocatorHashes = m.chain.GetBlockLocatorHashes()
+	gHeaders.HashStop = *maxHash
+	p.QueueMessage(gHeaders, nil)
+}
+
+// handleReorg rolls back the transactions affected by a reorg and restarts
+// phase one from the fork point, discarding anything still in flight past
+// it. This can happen even after the initial sync has finished - a single
+// new block delivered via the block fetcher can still reorg the tip - so it
+// has to put the chain back into Syncing itself; startHeaderSync refuses to
+// do anything otherwise.
+func (m *SyncManager) handleReorg(p *peer.Peer, reorgHeight int32) {
+	if err := m.txStore.ProcessReorg(reorgHeight); err != nil {
+		log.Error(err)
+	}
+	m.downloadQueue = nil
+	m.requestedBlocks = newHashLRU(maxRequestedBlocks)
+	m.chain.SetChainState(Syncing)
+	m.startHeaderSync(p)
+}
+
+// startBlockDownload fans the merkle block requests queued up during header
+// sync out across every connected peer, keeping at least minInFlightBlocks
+// outstanding per peer and capping total outstanding requests at
+// wire.MaxInvPerMsg.
+func (m *SyncManager) startBlockDownload() {
+	peers := m.peerManager.ConnectedPeers()
+	if len(peers) == 0 {
+		return
+	}
+	inFlight := make(map[int32]int)
+	m.requestedBlocks.ForEach(func(_ chainhash.Hash, value interface{}) {
+		inFlight[value.(*peer.Peer).ID()]++
+	})
+	for _, p := range peers {
+		for len(m.downloadQueue) > 0 &&
+			m.requestedBlocks.Len() < wire.MaxInvPerMsg &&
+			inFlight[p.ID()] < minInFlightBlocks {
+			m.requestNextBlock(p)
+			inFlight[p.ID()]++
+		}
+	}
+}
+
+// requestNextBlock pops the next queued hash and requests the filtered
+// block for it from p, tracking the request so a stalled peer's work can be
+// handed off to someone else.
+func (m *SyncManager) requestNextBlock(p *peer.Peer) {
+	if len(m.downloadQueue) == 0 {
+		return
+	}
+	hash := m.downloadQueue[0]
+	m.downloadQueue = m.downloadQueue[1:]
+	m.requestedBlocks.Add(hash, p)
+	gData := wire.NewMsgGetData()
+	gData.AddInvVect(wire.NewInvVect(wire.InvTypeFilteredBlock, &hash))
+	p.QueueMessage(gData, nil)
+	time.AfterFunc(blockRequestTimeout, func() {
+		select {
+		case m.msgChan <- blockTimeoutMsg{hash: hash, peer: p}:
+		case <-m.quit:
+		}
+	})
+}
+
+// handleBlockTimeout reassigns a merkle block request to another peer if
+// it's still outstanding against p when the timeout fires.
+func (m *SyncManager) handleBlockTimeout(hash chainhash.Hash, p *peer.Peer) {
+	value, ok := m.requestedBlocks.Get(hash)
+	owner, _ := value.(*peer.Peer)
+	if !ok || owner.ID() != p.ID() {
+		return
+	}
+	m.requestedBlocks.Remove(hash)
+	log.Warningf("Peer%d timed out fetching merkle block %s, reassigning", p.ID(), hash.String())
+	if ps := m.peerScores.Get(p); ps != nil {
+		ps.RecordTimeout()
+	}
+	if m.syncPeer != nil && m.syncPeer.ID() == p.ID() {
+		m.trySwitchSyncPeer()
+	}
+	next := m.nextBlockPeer(p)
+	if next == nil {
+		m.downloadQueue = append([]chainhash.Hash{hash}, m.downloadQueue...)
+		return
+	}
+	m.requestedBlocks.Add(hash, next)
+	gData := wire.NewMsgGetData()
+	gData.AddInvVect(wire.NewInvVect(wire.InvTypeFilteredBlock, &hash))
+	next.QueueMessage(gData, nil)
+	time.AfterFunc(blockRequestTimeout, func() {
+		select {
+		case m.msgChan <- blockTimeoutMsg{hash: hash, peer: next}:
+		case <-m.quit:
+		}
+	})
+}
+
+// nextBlockPeer picks a peer to reassign a timed-out block request to,
+// preferring the best-scoring peer over the one that just timed out so a
+// stalled request doesn't simply bounce back to the same bad peer. It falls
+// back to any other connected peer if scoring has nothing better to offer.
+func (m *SyncManager) nextBlockPeer(exclude *peer.Peer) *peer.Peer {
+	if best := m.BestPeer(); best != nil && best.Peer().ID() != exclude.ID() {
+		return best.Peer()
+	}
+	for _, cand := range m.peerManager.ConnectedPeers() {
+		if cand.ID() != exclude.ID() {
+			return cand
+		}
+	}
+	return nil
+}
+
+// handleMerkleBlock processes a merkle block received during phase two,
+// committing its header and recording the height each matched transaction
+// confirms at for handleTx to use, then keeps the download queue moving.
+func (m *SyncManager) handleMerkleBlock(p *peer.Peer, msg *wire.MsgMerkleBlock) {
+	txids, err := m.verifyMerkleBlock(msg)
+	if err != nil {
+		log.Errorf("Peer%d sent an invalid MerkleBlock", p.ID())
+		ps := m.peerScores.Get(p)
+		if ps == nil {
+			p.Disconnect()
+			return
+		}
+		ps.RecordInvalidBlock()
+		if ps.Banned() {
+			p.Disconnect()
+		}
+		return
+	}
+	headerHash := msg.Header.BlockHash()
+	viaFetcher := m.blockFetcher.IsPending(headerHash)
+	m.blockFetcher.Delivered(headerHash)
+	m.requestedBlocks.Remove(headerHash)
+	if ps := m.peerScores.Get(p); ps != nil {
+		ps.RecordBlock(merkleBlockSize(msg))
+		if m.syncPeer != nil && m.syncPeer.ID() == p.ID() &&
+			ps.Throughput() > 0 && ps.Throughput() < minSyncPeerThroughput {
+			log.Infof("Peer%d's throughput dropped to %.0f B/s, looking for a better sync peer", p.ID(), ps.Throughput())
+			m.trySwitchSyncPeer()
+		}
+	}
+
+	newBlock, reorgHeight, height, err := m.chain.CommitHeader(msg.Header)
+	if err != nil {
+		log.Warning(err)
+		return
+	}
+	if !newBlock {
+		return
+	}
+	if reorgHeight != nil {
+		m.handleReorg(p, *reorgHeight)
+		return
+	}
+
+	for _, txid := range txids {
+		m.txHeights.Add(*txid, height)
+	}
+	log.Debugf("Received Merkle Block %s at height %d\n", headerHash.String(), height)
+	m.chainTips.Publish(msg.Header)
+
+	// Blocks delivered by the fetcher are known-tip extensions, not sync
+	// payloads, so they skip the download-queue bookkeeping entirely.
+	if !viaFetcher && m.chain.ChainState() == Syncing {
+		m.requestNextBlock(p)
+		if len(m.downloadQueue) == 0 && m.requestedBlocks.Len() == 0 {
+			log.Info("Chain download complete")
+			m.chain.SetChainState(Waiting)
+			m.handleRebroadcast()
+		}
+	}
+	if m.chain.ChainState() == Waiting {
+		m.markExpiredTxnsDead()
+	}
+}
+
+// merkleBlockSize approximates the wire size of a merkle block, for
+// throughput measurement purposes.
+func merkleBlockSize(msg *wire.MsgMerkleBlock) int {
+	return wire.MaxBlockHeaderPayload + len(msg.Hashes)*chainhash.HashSize + len(msg.Flags)
+}
+
+// markExpiredTxnsDead marks any still-unconfirmed transaction older than
+// the manager's unconfirmed timeout as dead.
+func (m *SyncManager) markExpiredTxnsDead() {
+	txns, err := m.txStore.GetAllTxns(false)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	now := time.Now()
+	for i := len(txns) - 1; i >= 0; i-- {
+		if txns[i].Height != 0 || !now.After(txns[i].Timestamp.Add(m.unconfirmedTimeout)) {
+			continue
+		}
+		log.Noticef("Marking tx as dead %s", txns[i].Txid)
+		h, err := chainhash.NewHashFromStr(txns[i].Txid)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if err := m.txStore.MarkAsDead(*h); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// handleTx processes an incoming transaction, crediting it against the
+// height its containing merkleblock committed at (if any) and tracking
+// repeated filter false positives per peer. We deliberately leave txHeights
+// alone here: deleting it the moment a tx is ingested used to reset a
+// confirmed tx's height back to zero the next time a peer relayed the same
+// tx to us. The entry is left to age out of the LRU instead, which is
+// naturally bounded without reintroducing that bug.
+func (m *SyncManager) handleTx(p *peer.Peer, tx *wire.MsgTx) {
+	var height int32
+	if v, ok := m.txHeights.Get(tx.TxHash()); ok {
+		height = v.(int32)
+	}
+	hits, err := m.txStore.Ingest(tx, height)
+	if err != nil {
+		log.Errorf("Error ingesting tx: %s\n", err.Error())
+		m.requestedTxns.Remove(tx.TxHash())
+		m.rejectedTxns.Add(tx.TxHash(), struct{}{})
+		return
+	}
+	if hits == 0 {
+		log.Debugf("Tx %s from Peer%d had no hits, filter false positive.", tx.TxHash().String(), p.ID())
+		m.requestedTxns.Remove(tx.TxHash())
+		m.rejectedTxns.Add(tx.TxHash(), struct{}{})
+		if ps := m.peerScores.Get(p); ps != nil {
+			ps.RecordFalsePositive()
+			if ps.FalsePositiveCount() > 7 {
+				m.updateFilterAndSend(p)
+				log.Debugf("Reset %d false positives for Peer%d\n", ps.FalsePositiveCount(), p.ID())
+				ps.ResetFalsePositives()
+			}
+		}
+		return
+	}
+	m.requestedTxns.Remove(tx.TxHash())
+	m.updateFilterAndSend(p)
+	log.Infof("Tx %s from Peer%d ingested and matches %d utxo/adrs.", tx.TxHash().String(), p.ID(), hits)
+}
+
+// handleInv processes an inv announcement, skipping anything we've already
+// requested or already rejected so we don't round-trip a getdata for it.
+// Once we're caught up, single-block announcements go to the block fetcher
+// instead of the bulk download queue, since at that point they're new-tip
+// extensions rather than sync payloads.
+func (m *SyncManager) handleInv(p *peer.Peer, msg *wire.MsgInv) {
+	for _, inv := range msg.InvList {
+		switch inv.Type {
+		case wire.InvTypeBlock:
+			if m.chain.ChainState() == Waiting {
+				m.blockFetcher.Announce(p, inv.Hash)
+				continue
+			}
+			if m.requestedBlocks.Contains(inv.Hash) {
+				continue
+			}
+			inv.Type = wire.InvTypeFilteredBlock
+			m.requestedBlocks.Add(inv.Hash, p)
+			gData := wire.NewMsgGetData()
+			gData.AddInvVect(inv)
+			p.QueueMessage(gData, nil)
+		case wire.InvTypeTx:
+			if m.requestedTxns.Contains(inv.Hash) || m.rejectedTxns.Contains(inv.Hash) {
+				continue
+			}
+			m.requestedTxns.Add(inv.Hash, struct{}{})
+			gData := wire.NewMsgGetData()
+			gData.AddInvVect(inv)
+			p.QueueMessage(gData, nil)
+		default:
+			continue
+		}
+	}
+}
+
+// handleGetData answers a peer's request for transactions we hold.
+func (m *SyncManager) handleGetData(p *peer.Peer, msg *wire.MsgGetData) {
+	log.Debugf("Received getdata request from Peer%d\n", p.ID())
+	var sent int32
+	for _, thing := range msg.InvList {
+		if thing.Type != wire.InvTypeTx {
+			log.Debugf("We only respond to tx requests, ignoring")
+			continue
+		}
+		tx, err := m.txStore.GetTx(thing.Hash)
+		if err != nil {
+			log.Errorf("Error getting tx %s: %s", thing.Hash.String(), err.Error())
+			continue
+		}
+		p.QueueMessage(tx, nil)
+		sent++
+	}
+	log.Debugf("Sent %d of %d requested items to Peer%d", sent, len(msg.InvList), p.ID())
+}
+
+// handleRebroadcast resends all pending transactions to every connected
+// peer.
+func (m *SyncManager) handleRebroadcast() {
+	invMsg, err := m.txStore.GetPendingInv()
+	if err != nil {
+		log.Errorf("Rebroadcast error: %s", err.Error())
+		return
+	}
+	if len(invMsg.InvList) == 0 {
+		return
+	}
+	for _, p := range m.peerManager.ConnectedPeers() {
+		p.QueueMessage(invMsg, nil)
+	}
+}
+
+// updateFilterAndSend pushes a fresh bloom filter to p.
+func (m *SyncManager) updateFilterAndSend(p *peer.Peer) {
+	filt, err := m.txStore.GimmeFilter()
+	if err != nil {
+		log.Errorf("Error creating filter: %s\n", err.Error())
+		return
+	}
+	p.QueueMessage(filt.MsgFilterLoad(), nil)
+	log.Debugf("Sent filter to Peer%d\n", p.ID())
+}
@@ -0,0 +1,67 @@
+package netsync
+
+import (
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ChainState describes whether the wallet is still catching up to the
+// network or is caught up and just watching for new blocks.
+type ChainState int
+
+const (
+	Syncing ChainState = iota
+	Waiting
+)
+
+// Chain is the subset of spvwallet.Blockchain the sync manager needs in
+// order to drive an initial header/block sync. It's defined here, rather
+// than depending on the concrete blockchain type, so that this package
+// doesn't have to import spvwallet.
+type Chain interface {
+	ChainState() ChainState
+	SetChainState(ChainState)
+	Height() uint32
+	GetBlockLocatorHashes() []*chainhash.Hash
+
+	// CommitHeader validates and stores header. newBlock is false if the
+	// header was already known. reorgHeight is non-nil when committing
+	// header caused the chain to roll back to an earlier fork point (even
+	// to height 0); the chain has already persisted that rollback by the
+	// time this returns.
+	CommitHeader(header wire.BlockHeader) (newBlock bool, reorgHeight *int32, height int32, err error)
+}
+
+// Txn is a trimmed down view of a wallet transaction, just enough for the
+// sync manager to decide whether it should be marked dead.
+type Txn struct {
+	Txid      string
+	Height    int32
+	Timestamp time.Time
+}
+
+// Filter is satisfied by the wallet's bloom filter wrapper.
+type Filter interface {
+	MsgFilterLoad() *wire.MsgFilterLoad
+}
+
+// TxStore is the subset of spvwallet.TxStore the sync manager needs.
+type TxStore interface {
+	Ingest(tx *wire.MsgTx, height int32) (uint32, error)
+	GetPendingInv() (*wire.MsgInv, error)
+	GimmeFilter() (Filter, error)
+	MarkAsDead(txid chainhash.Hash) error
+	ProcessReorg(height int32) error
+	GetAllTxns(includeWatchOnly bool) ([]Txn, error)
+	GetTx(txid chainhash.Hash) (*wire.MsgTx, error)
+}
+
+// PeerManager is the subset of spvwallet.PeerManager the sync manager needs.
+type PeerManager interface {
+	ConnectedPeers() []*peer.Peer
+	DownloadPeer() *peer.Peer
+	CheckForMoreBlocks(height uint32) bool
+}
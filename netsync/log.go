@@ -0,0 +1,16 @@
+package netsync
+
+import (
+	"github.com/op/go-logging"
+)
+
+// log is the subsystem logger for the sync manager. Until SetLogger is
+// called it is go-logging's "netsync" module logger, which writes through
+// go-logging's default backend.
+var log = logging.MustGetLogger("netsync")
+
+// SetLogger lets callers plug the manager into the rest of the
+// application's logging setup.
+func SetLogger(logger *logging.Logger) {
+	log = logger
+}
@@ -0,0 +1,84 @@
+package netsync
+
+import (
+	"container/list"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// hashLRU is a fixed-capacity, insertion-ordered cache keyed by hash. Once
+// it reaches its limit, adding a new entry evicts the oldest one. It backs
+// the sync manager's requestedBlocks, requestedTxns, rejectedTxns and
+// txHeights tracking so none of them can grow without bound, the same
+// shape btcd's netsync.SyncManager uses for its own inventory caches.
+type hashLRU struct {
+	limit   int
+	order   *list.List
+	entries map[chainhash.Hash]*list.Element
+}
+
+type hashLRUEntry struct {
+	hash  chainhash.Hash
+	value interface{}
+}
+
+func newHashLRU(limit int) *hashLRU {
+	return &hashLRU{
+		limit:   limit,
+		order:   list.New(),
+		entries: make(map[chainhash.Hash]*list.Element),
+	}
+}
+
+// Get returns the value stored under hash, if any.
+func (c *hashLRU) Get(hash chainhash.Hash) (interface{}, bool) {
+	el, ok := c.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(*hashLRUEntry).value, true
+}
+
+// Contains reports whether hash is currently tracked.
+func (c *hashLRU) Contains(hash chainhash.Hash) bool {
+	_, ok := c.entries[hash]
+	return ok
+}
+
+// Add records value under hash, evicting the oldest entry first if the
+// cache is already at capacity.
+func (c *hashLRU) Add(hash chainhash.Hash, value interface{}) {
+	if el, ok := c.entries[hash]; ok {
+		el.Value.(*hashLRUEntry).value = value
+		return
+	}
+	if c.order.Len() >= c.limit {
+		if oldest := c.order.Front(); oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*hashLRUEntry).hash)
+		}
+	}
+	c.entries[hash] = c.order.PushBack(&hashLRUEntry{hash: hash, value: value})
+}
+
+// Remove drops hash from the cache, if present.
+func (c *hashLRU) Remove(hash chainhash.Hash) {
+	if el, ok := c.entries[hash]; ok {
+		c.order.Remove(el)
+		delete(c.entries, hash)
+	}
+}
+
+func (c *hashLRU) Len() int {
+	return c.order.Len()
+}
+
+// ForEach calls fn once for every entry currently in the cache, oldest
+// first. fn must not mutate the cache; collect what you need to change and
+// apply it after ForEach returns.
+func (c *hashLRU) ForEach(fn func(hash chainhash.Hash, value interface{})) {
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*hashLRUEntry)
+		fn(entry.hash, entry.value)
+	}
+}
@@ -0,0 +1,89 @@
+package netsync
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+func hashOf(b byte) chainhash.Hash {
+	var h chainhash.Hash
+	h[0] = b
+	return h
+}
+
+func TestHashLRUAddAndGet(t *testing.T) {
+	c := newHashLRU(2)
+	h1 := hashOf(1)
+	c.Add(h1, "one")
+	v, ok := c.Get(h1)
+	if !ok || v != "one" {
+		t.Fatalf("Get(h1) = %v, %v; want \"one\", true", v, ok)
+	}
+	if !c.Contains(h1) {
+		t.Fatal("Contains(h1) = false, want true")
+	}
+}
+
+func TestHashLRUEvictsOldestOnOverflow(t *testing.T) {
+	c := newHashLRU(2)
+	h1, h2, h3 := hashOf(1), hashOf(2), hashOf(3)
+	c.Add(h1, 1)
+	c.Add(h2, 2)
+	c.Add(h3, 3)
+
+	if c.Contains(h1) {
+		t.Fatal("oldest entry h1 should have been evicted")
+	}
+	if !c.Contains(h2) || !c.Contains(h3) {
+		t.Fatal("h2 and h3 should still be present")
+	}
+	if c.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", c.Len())
+	}
+}
+
+func TestHashLRUAddExistingUpdatesValueWithoutEviction(t *testing.T) {
+	c := newHashLRU(2)
+	h1, h2 := hashOf(1), hashOf(2)
+	c.Add(h1, "old")
+	c.Add(h2, "two")
+	c.Add(h1, "new")
+
+	v, ok := c.Get(h1)
+	if !ok || v != "new" {
+		t.Fatalf("Get(h1) = %v, %v; want \"new\", true", v, ok)
+	}
+	if !c.Contains(h2) {
+		t.Fatal("updating an existing key should not evict other entries")
+	}
+}
+
+func TestHashLRURemove(t *testing.T) {
+	c := newHashLRU(2)
+	h1 := hashOf(1)
+	c.Add(h1, "one")
+	c.Remove(h1)
+	if c.Contains(h1) {
+		t.Fatal("Contains(h1) = true after Remove")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("Len() = %d, want 0", c.Len())
+	}
+}
+
+func TestHashLRUForEachOldestFirst(t *testing.T) {
+	c := newHashLRU(3)
+	h1, h2, h3 := hashOf(1), hashOf(2), hashOf(3)
+	c.Add(h1, 1)
+	c.Add(h2, 2)
+	c.Add(h3, 3)
+
+	var seen []byte
+	c.ForEach(func(hash chainhash.Hash, value interface{}) {
+		seen = append(seen, hash[0])
+	})
+	if len(seen) != 3 || seen[0] != 1 || seen[1] != 2 || seen[2] != 3 {
+		t.Fatalf("ForEach order = %v, want [1 2 3]", seen)
+	}
+}
@@ -0,0 +1,305 @@
+// Package netsync implements the block and transaction synchronization
+// logic for spvwallet. It follows the shape of btcd's netsync.SyncManager:
+// a single event-loop goroutine owns all sync-related state, and peer
+// callbacks are reduced to thin shims that hand messages to it over a
+// channel. This removes the need for the mutex-guarded shared state the
+// wallet previously juggled across its peer callbacks.
+package netsync
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+
+	"github.com/Eric-GreenComb/spvwallet/netsync/peers"
+)
+
+const (
+	// msgChanBufferSize is how many pending peer messages the manager will
+	// buffer before peer goroutines start blocking on QueueX calls.
+	msgChanBufferSize = 100
+
+	// minInFlightBlocks is the minimum number of merkle block requests the
+	// manager tries to keep outstanding per peer while draining the
+	// download queue built up during header sync.
+	minInFlightBlocks = 10
+
+	// blockRequestTimeout is how long the manager gives a peer to answer a
+	// merkle block request before reassigning it to someone else.
+	blockRequestTimeout = 30 * time.Second
+
+	// Bounds on the manager's inventory caches, sized the same way btcd's
+	// netsync.SyncManager sizes its own requested/rejected maps.
+	maxRequestedBlocks = wire.MaxInvPerMsg
+	maxRequestedTxns   = wire.MaxInvPerMsg
+	maxRejectedTxns    = 1000
+	maxTxHeights       = wire.MaxInvPerMsg
+
+	// minSyncPeerThroughput is the bytes/sec below which we consider the
+	// sync peer to be dragging and look for a better one.
+	minSyncPeerThroughput = 1024
+)
+
+var maxHash *chainhash.Hash
+
+func init() {
+	h, err := chainhash.NewHashFromStr("0000000000000000000000000000000000000000000000000000000000000000")
+	if err != nil {
+		panic(err)
+	}
+	maxHash = h
+}
+
+// Config holds everything the sync manager needs from the rest of the
+// wallet. It's the only thing SPVWallet has to construct by hand; from
+// there SyncManager owns its own state.
+type Config struct {
+	Chain       Chain
+	TxStore     TxStore
+	PeerManager PeerManager
+
+	// UnconfirmedTimeout is how long an unconfirmed transaction is kept
+	// around before it's marked dead.
+	UnconfirmedTimeout time.Duration
+
+	// VerifyMerkleBlock checks a merkle block's partial merkle tree against
+	// its header and returns the txids it matched.
+	VerifyMerkleBlock func(*wire.MsgMerkleBlock) ([]*chainhash.Hash, error)
+}
+
+// SyncManager owns all of the state that used to be spread across
+// SPVWallet's peer callbacks and mutex. Everything in this struct from
+// syncPeer down is only ever touched from the messageHandler goroutine,
+// except peerScores, blockFetcher and chainTips, which guard themselves with
+// their own mutex and are also used from other goroutines.
+type SyncManager struct {
+	started  int32
+	shutdown int32
+
+	chain       Chain
+	txStore     TxStore
+	peerManager PeerManager
+
+	unconfirmedTimeout time.Duration
+	verifyMerkleBlock  func(*wire.MsgMerkleBlock) ([]*chainhash.Hash, error)
+
+	msgChan chan interface{}
+	quit    chan struct{}
+	wg      sync.WaitGroup
+
+	syncPeer *peer.Peer
+
+	downloadQueue []chainhash.Hash
+
+	// requestedBlocks and requestedTxns track outstanding getdata requests
+	// so onInv doesn't issue a second one for something we're already
+	// fetching. rejectedTxns remembers txns we've already thrown away (a
+	// filter false positive or a failed Ingest) so a re-announcement is
+	// dropped without a round-trip. txHeights carries the height a
+	// merkleblock commit expects a txid to confirm at, for onTx to read.
+	// All four are bounded LRUs so a chatty or malicious peer can't grow
+	// them without limit.
+	requestedBlocks *hashLRU
+	requestedTxns   *hashLRU
+	rejectedTxns    *hashLRU
+	txHeights       *hashLRU
+
+	// peerScores tracks per-peer throughput, timeouts, invalid blocks and
+	// false positives, used to pick and demote sync peers.
+	peerScores *peers.Set
+
+	// blockFetcher handles single-block tip announcements once we're caught
+	// up, separately from the bulk download queue above.
+	blockFetcher *BlockFetcher
+
+	// chainTips lets wallet consumers watch for newly committed blocks via
+	// SubscribeChainTip instead of polling.
+	chainTips chainTipBroadcaster
+}
+
+// New creates a sync manager from cfg. Callers must call Start before
+// feeding it any peer events.
+func New(cfg *Config) *SyncManager {
+	m := &SyncManager{
+		chain:              cfg.Chain,
+		txStore:            cfg.TxStore,
+		peerManager:        cfg.PeerManager,
+		unconfirmedTimeout: cfg.UnconfirmedTimeout,
+		verifyMerkleBlock:  cfg.VerifyMerkleBlock,
+		msgChan:            make(chan interface{}, msgChanBufferSize),
+		quit:               make(chan struct{}),
+		requestedBlocks:    newHashLRU(maxRequestedBlocks),
+		requestedTxns:      newHashLRU(maxRequestedTxns),
+		rejectedTxns:       newHashLRU(maxRejectedTxns),
+		txHeights:          newHashLRU(maxTxHeights),
+		peerScores:         peers.NewSet(),
+	}
+	m.blockFetcher = newBlockFetcher(
+		func(p *peer.Peer, hash chainhash.Hash) {
+			gData := wire.NewMsgGetData()
+			gData.AddInvVect(wire.NewInvVect(wire.InvTypeFilteredBlock, &hash))
+			p.QueueMessage(gData, nil)
+		},
+		func(hash chainhash.Hash) {
+			log.Warningf("All announcers of block %s timed out", hash.String())
+		},
+	)
+	return m
+}
+
+// SubscribeChainTip returns a channel that receives the header of each new
+// block the manager commits to the chain. The channel buffers one header; a
+// subscriber that has not drained it misses later tips.
+func (m *SyncManager) SubscribeChainTip() <-chan wire.BlockHeader {
+	return m.chainTips.Subscribe()
+}
+
+// BestPeer returns the highest-scoring connected peer whose advertised
+// height still exceeds ours, or nil if no peer qualifies.
+func (m *SyncManager) BestPeer() *peers.PeerScore {
+	return m.peerScores.Best(m.chain.Height())
+}
+
+// Start launches the manager's event loop. It's safe to call more than
+// once; only the first call has any effect.
+func (m *SyncManager) Start() {
+	if atomic.AddInt32(&m.started, 1) != 1 {
+		return
+	}
+	log.Info("Starting sync manager")
+	m.wg.Add(1)
+	go m.messageHandler()
+}
+
+// Stop shuts the manager down and waits for the event loop to exit.
+func (m *SyncManager) Stop() error {
+	if atomic.AddInt32(&m.shutdown, 1) != 1 {
+		log.Warning("Sync manager already stopped")
+		return nil
+	}
+	close(m.quit)
+	m.wg.Wait()
+	return nil
+}
+
+// NewPeer informs the manager of a newly connected peer.
+func (m *SyncManager) NewPeer(p *peer.Peer) {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return
+	}
+	m.msgChan <- newPeerMsg{peer: p}
+}
+
+// DonePeer informs the manager that a peer has disconnected.
+func (m *SyncManager) DonePeer(p *peer.Peer) {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return
+	}
+	m.msgChan <- donePeerMsg{peer: p}
+}
+
+// QueueHeaders queues a headers message for processing on the event loop.
+func (m *SyncManager) QueueHeaders(headers *wire.MsgHeaders, p *peer.Peer) {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return
+	}
+	m.msgChan <- headersMsg{headers: headers, peer: p}
+}
+
+// QueueMerkleBlock queues a merkle block message for processing on the
+// event loop.
+func (m *SyncManager) QueueMerkleBlock(block *wire.MsgMerkleBlock, p *peer.Peer) {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return
+	}
+	m.msgChan <- merkleBlockMsg{block: block, peer: p}
+}
+
+// QueueTx queues a tx message for processing on the event loop.
+func (m *SyncManager) QueueTx(tx *wire.MsgTx, p *peer.Peer) {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return
+	}
+	m.msgChan <- txMsg{tx: tx, peer: p}
+}
+
+// QueueInv queues an inv message for processing on the event loop.
+func (m *SyncManager) QueueInv(inv *wire.MsgInv, p *peer.Peer) {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return
+	}
+	m.msgChan <- invMsg{inv: inv, peer: p}
+}
+
+// QueueGetData queues a getdata message for processing on the event loop.
+func (m *SyncManager) QueueGetData(getData *wire.MsgGetData, p *peer.Peer) {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return
+	}
+	m.msgChan <- getDataMsg{getData: getData, peer: p}
+}
+
+// Rebroadcast asks the manager to rebroadcast any pending transactions to
+// all connected peers.
+func (m *SyncManager) Rebroadcast() {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return
+	}
+	m.msgChan <- rebroadcastMsg{}
+}
+
+// IsCurrent reports whether the manager believes it's caught up with the
+// network. It returns false once the manager has been stopped, since the
+// event loop that would otherwise answer is no longer running.
+func (m *SyncManager) IsCurrent() bool {
+	if atomic.LoadInt32(&m.shutdown) != 0 {
+		return false
+	}
+	reply := make(chan bool, 1)
+	m.msgChan <- isCurrentMsg{reply: reply}
+	return <-reply
+}
+
+// messageHandler is the manager's single event-loop goroutine. All state
+// from syncPeer down in SyncManager, other than the self-locking peerScores,
+// blockFetcher and chainTips, is only ever read or written from here.
+func (m *SyncManager) messageHandler() {
+	defer m.wg.Done()
+out:
+	for {
+		select {
+		case msg := <-m.msgChan:
+			switch v := msg.(type) {
+			case newPeerMsg:
+				m.handleNewPeer(v.peer)
+			case donePeerMsg:
+				m.handleDonePeer(v.peer)
+			case headersMsg:
+				m.handleHeaders(v.peer, v.headers)
+			case merkleBlockMsg:
+				m.handleMerkleBlock(v.peer, v.block)
+			case txMsg:
+				m.handleTx(v.peer, v.tx)
+			case invMsg:
+				m.handleInv(v.peer, v.inv)
+			case getDataMsg:
+				m.handleGetData(v.peer, v.getData)
+			case rebroadcastMsg:
+				m.handleRebroadcast()
+			case blockTimeoutMsg:
+				m.handleBlockTimeout(v.hash, v.peer)
+			case isCurrentMsg:
+				v.reply <- m.chain.ChainState() == Waiting
+			default:
+				log.Warningf("Invalid message type in message handler: %T", v)
+			}
+		case <-m.quit:
+			break out
+		}
+	}
+	log.Debug("Sync manager event loop stopped")
+}
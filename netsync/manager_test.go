@@ -0,0 +1,210 @@
+package netsync
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// commitResult scripts one return value for fakeChain.CommitHeader, consumed
+// in the order headers are committed.
+type commitResult struct {
+	newBlock    bool
+	reorgHeight *int32
+	height      int32
+	err         error
+}
+
+// fakeChain is a scriptable Chain for exercising the manager's event-loop
+// handlers without a real blockchain.
+type fakeChain struct {
+	state         ChainState
+	height        uint32
+	commitResults []commitResult
+
+	commitCalls   []wire.BlockHeader
+	setStateCalls []ChainState
+	locatorCalls  int
+}
+
+func (c *fakeChain) ChainState() ChainState { return c.state }
+
+func (c *fakeChain) SetChainState(s ChainState) {
+	c.setStateCalls = append(c.setStateCalls, s)
+	c.state = s
+}
+
+func (c *fakeChain) Height() uint32 { return c.height }
+
+func (c *fakeChain) GetBlockLocatorHashes() []*chainhash.Hash {
+	c.locatorCalls++
+	return nil
+}
+
+func (c *fakeChain) CommitHeader(header wire.BlockHeader) (bool, *int32, int32, error) {
+	c.commitCalls = append(c.commitCalls, header)
+	if len(c.commitResults) == 0 {
+		return true, nil, 0, nil
+	}
+	r := c.commitResults[0]
+	c.commitResults = c.commitResults[1:]
+	return r.newBlock, r.reorgHeight, r.height, r.err
+}
+
+// fakeTxStore is a scriptable TxStore.
+type fakeTxStore struct {
+	reorgCalls []int32
+}
+
+func (f *fakeTxStore) Ingest(tx *wire.MsgTx, height int32) (uint32, error) { return 0, nil }
+
+func (f *fakeTxStore) GetPendingInv() (*wire.MsgInv, error) { return wire.NewMsgInv(), nil }
+
+func (f *fakeTxStore) GimmeFilter() (Filter, error) { return nil, errors.New("not implemented") }
+
+func (f *fakeTxStore) MarkAsDead(txid chainhash.Hash) error { return nil }
+
+func (f *fakeTxStore) ProcessReorg(height int32) error {
+	f.reorgCalls = append(f.reorgCalls, height)
+	return nil
+}
+
+func (f *fakeTxStore) GetAllTxns(includeWatchOnly bool) ([]Txn, error) { return nil, nil }
+
+func (f *fakeTxStore) GetTx(txid chainhash.Hash) (*wire.MsgTx, error) {
+	return nil, errors.New("not found")
+}
+
+// fakePeerManager is a scriptable PeerManager.
+type fakePeerManager struct {
+	peers           []*peer.Peer
+	checkMoreResult bool
+}
+
+func (f *fakePeerManager) ConnectedPeers() []*peer.Peer { return f.peers }
+
+func (f *fakePeerManager) DownloadPeer() *peer.Peer {
+	if len(f.peers) == 0 {
+		return nil
+	}
+	return f.peers[0]
+}
+
+func (f *fakePeerManager) CheckForMoreBlocks(height uint32) bool { return f.checkMoreResult }
+
+func newTestManager(chain *fakeChain, txStore *fakeTxStore, pm *fakePeerManager) *SyncManager {
+	return New(&Config{
+		Chain:              chain,
+		TxStore:            txStore,
+		PeerManager:        pm,
+		UnconfirmedTimeout: time.Hour,
+		VerifyMerkleBlock: func(*wire.MsgMerkleBlock) ([]*chainhash.Hash, error) {
+			return nil, nil
+		},
+	})
+}
+
+func int32ptr(v int32) *int32 { return &v }
+
+func testHeader(i int64) wire.BlockHeader {
+	return wire.BlockHeader{Timestamp: time.Unix(i+1, 0)}
+}
+
+// TestHandleHeadersExhaustedTransitionsToBlockDownload checks that once a
+// peer has no more headers to send (a response shorter than
+// MaxBlockHeadersPerMsg), the manager moves straight into phase two and
+// starts requesting the queued blocks instead of waiting for something else
+// to kick off startBlockDownload.
+func TestHandleHeadersExhaustedTransitionsToBlockDownload(t *testing.T) {
+	chain := &fakeChain{state: Syncing, height: 10}
+	txStore := &fakeTxStore{}
+	p := testPeer(t, "127.0.0.1:8333")
+	p.UpdateLastBlockHeight(5)
+	pm := &fakePeerManager{peers: []*peer.Peer{p}}
+	m := newTestManager(chain, txStore, pm)
+
+	msg := wire.NewMsgHeaders()
+	for i := int64(0); i < 3; i++ {
+		h := testHeader(i)
+		msg.AddBlockHeader(&h)
+	}
+
+	m.handleHeaders(p, msg)
+
+	if len(m.downloadQueue) != 0 {
+		t.Fatalf("downloadQueue = %d entries, want 0 (all queued blocks should have been requested)", len(m.downloadQueue))
+	}
+	if m.requestedBlocks.Len() != 3 {
+		t.Fatalf("requestedBlocks.Len() = %d, want 3", m.requestedBlocks.Len())
+	}
+	if chain.state != Syncing {
+		t.Fatalf("chain state = %v, want Syncing (block download isn't done yet)", chain.state)
+	}
+}
+
+// TestHandleHeadersReorgMidSyncRestartsHeaderFetch checks that a reorg
+// reported partway through header sync clears in-flight state and goes
+// straight back to requesting more headers from the fork point, rather than
+// falling through to block download against the old chain.
+func TestHandleHeadersReorgMidSyncRestartsHeaderFetch(t *testing.T) {
+	chain := &fakeChain{
+		state:  Syncing,
+		height: 10,
+		commitResults: []commitResult{
+			{newBlock: true, reorgHeight: int32ptr(3), height: 3},
+		},
+	}
+	txStore := &fakeTxStore{}
+	p := testPeer(t, "127.0.0.1:8333")
+	p.UpdateLastBlockHeight(1_000_000) // far ahead, so startHeaderSync asks for more headers
+	pm := &fakePeerManager{peers: []*peer.Peer{p}}
+	m := newTestManager(chain, txStore, pm)
+	m.downloadQueue = []chainhash.Hash{{0x01}, {0x02}}
+	m.requestedBlocks.Add(chainhash.Hash{0x03}, p)
+
+	msg := wire.NewMsgHeaders()
+	h := testHeader(0)
+	msg.AddBlockHeader(&h)
+	m.handleHeaders(p, msg)
+
+	if len(txStore.reorgCalls) != 1 || txStore.reorgCalls[0] != 3 {
+		t.Fatalf("txStore.reorgCalls = %v, want [3]", txStore.reorgCalls)
+	}
+	if len(m.downloadQueue) != 0 || m.requestedBlocks.Len() != 0 {
+		t.Fatal("in-flight download state should be discarded on reorg")
+	}
+	if chain.locatorCalls != 1 {
+		t.Fatalf("GetBlockLocatorHashes calls = %d, want 1 (header sync should have restarted)", chain.locatorCalls)
+	}
+}
+
+// TestHandleReorgWhileWaitingRestartsSync is a regression test for a reorg
+// detected after the initial sync has finished (chain state Waiting), which
+// is the common case since post-sync blocks arrive one at a time via the
+// block fetcher. Without resetting the chain state back to Syncing first,
+// startHeaderSync refuses to do anything and the wallet stays wedged on the
+// old chain.
+func TestHandleReorgWhileWaitingRestartsSync(t *testing.T) {
+	chain := &fakeChain{state: Waiting, height: 50}
+	txStore := &fakeTxStore{}
+	p := testPeer(t, "127.0.0.1:8333")
+	p.UpdateLastBlockHeight(1_000_000)
+	pm := &fakePeerManager{peers: []*peer.Peer{p}}
+	m := newTestManager(chain, txStore, pm)
+
+	m.handleReorg(p, 7)
+
+	if len(txStore.reorgCalls) != 1 || txStore.reorgCalls[0] != 7 {
+		t.Fatalf("txStore.reorgCalls = %v, want [7]", txStore.reorgCalls)
+	}
+	if chain.state != Syncing {
+		t.Fatalf("chain state = %v, want Syncing", chain.state)
+	}
+	if chain.locatorCalls != 1 {
+		t.Fatal("startHeaderSync should have restarted header fetch instead of bailing out on the stale chain state")
+	}
+}
@@ -0,0 +1,59 @@
+package netsync
+
+import (
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/peer"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// These are the messages sent over the manager's msgChan. Everything the
+// event loop touches arrives as one of these so the rest of the manager's
+// state never has to be guarded by a mutex.
+type newPeerMsg struct {
+	peer *peer.Peer
+}
+
+type donePeerMsg struct {
+	peer *peer.Peer
+}
+
+type merkleBlockMsg struct {
+	block *wire.MsgMerkleBlock
+	peer  *peer.Peer
+}
+
+type headersMsg struct {
+	headers *wire.MsgHeaders
+	peer    *peer.Peer
+}
+
+type txMsg struct {
+	tx   *wire.MsgTx
+	peer *peer.Peer
+}
+
+type invMsg struct {
+	inv  *wire.MsgInv
+	peer *peer.Peer
+}
+
+type getDataMsg struct {
+	getData *wire.MsgGetData
+	peer    *peer.Peer
+}
+
+type rebroadcastMsg struct{}
+
+// blockTimeoutMsg is fed back into the event loop by a timer started when a
+// merkle block request goes out, so reassigning a stalled request is still
+// handled only from the event-loop goroutine.
+type blockTimeoutMsg struct {
+	hash chainhash.Hash
+	peer *peer.Peer
+}
+
+// isCurrentMsg is a request/response pair used by IsCurrent to read manager
+// state from outside the event-loop goroutine without a mutex.
+type isCurrentMsg struct {
+	reply chan bool
+}
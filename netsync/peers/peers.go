@@ -0,0 +1,206 @@
+// Package peers implements per-peer scoring for the sync manager, modeled
+// on Bytom's netsync/peers package and btcd's sync-peer selection. It tracks
+// enough about each connected peer - advertised height, merkleblock
+// throughput, timeouts, invalid blocks and filter false positives - to pick
+// a good sync peer and to demote or disconnect a bad one instead of relying
+// on a single strike.
+package peers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/peer"
+)
+
+const (
+	// throughputWindow is how often RecordBlock rolls the byte counter into
+	// a bytes/sec measurement.
+	throughputWindow = 10 * time.Second
+
+	// Ban score penalties. A peer is disconnected once its accumulated
+	// score crosses banThreshold.
+	banThreshold         = 100
+	timeoutPenalty       = 20
+	invalidBlockPenalty  = 50
+	falsePositivePenalty = 5
+)
+
+// PeerScore tracks what the sync manager knows about how well a single peer
+// has been performing.
+type PeerScore struct {
+	peer *peer.Peer
+
+	mu                 sync.Mutex
+	windowStart        time.Time
+	bytesInWindow      int64
+	throughput         float64 // bytes/sec, as of the last completed window
+	timeoutCount       int
+	invalidBlockCount  int
+	falsePositiveCount int // since the filter was last refreshed
+	banScore           int
+}
+
+func newPeerScore(p *peer.Peer) *PeerScore {
+	return &PeerScore{peer: p, windowStart: time.Now()}
+}
+
+// Peer returns the underlying peer this score is tracking.
+func (s *PeerScore) Peer() *peer.Peer {
+	return s.peer
+}
+
+// LastBlock returns the peer's last advertised height.
+func (s *PeerScore) LastBlock() int32 {
+	return s.peer.LastBlock()
+}
+
+// RecordBlock credits n bytes of merkle block payload towards the peer's
+// rolling throughput measurement.
+func (s *PeerScore) RecordBlock(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elapsed := time.Since(s.windowStart); elapsed >= throughputWindow {
+		s.throughput = float64(s.bytesInWindow) / elapsed.Seconds()
+		s.bytesInWindow = 0
+		s.windowStart = time.Now()
+	}
+	s.bytesInWindow += int64(n)
+}
+
+// Throughput returns the peer's measured bytes/sec as of the last completed
+// window. It's zero until a full window has elapsed.
+func (s *PeerScore) Throughput() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.throughput
+}
+
+// RecordTimeout notes that a request to this peer went unanswered.
+func (s *PeerScore) RecordTimeout() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeoutCount++
+	s.banScore += timeoutPenalty
+}
+
+// RecordInvalidBlock notes that this peer sent us a merkle block that
+// didn't check out.
+func (s *PeerScore) RecordInvalidBlock() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidBlockCount++
+	s.banScore += invalidBlockPenalty
+}
+
+// RecordFalsePositive notes a bloom filter false positive from this peer.
+func (s *PeerScore) RecordFalsePositive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.falsePositiveCount++
+	s.banScore += falsePositivePenalty
+}
+
+// FalsePositiveCount returns the false positives seen since the filter was
+// last reset.
+func (s *PeerScore) FalsePositiveCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.falsePositiveCount
+}
+
+// ResetFalsePositives clears the rolling false-positive counter, called
+// once we've sent the peer a refreshed filter.
+func (s *PeerScore) ResetFalsePositives() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.falsePositiveCount = 0
+}
+
+// BanScore returns the peer's accumulated misbehavior score.
+func (s *PeerScore) BanScore() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.banScore
+}
+
+// Banned reports whether the peer has crossed the ban threshold and should
+// be disconnected.
+func (s *PeerScore) Banned() bool {
+	return s.BanScore() >= banThreshold
+}
+
+// Set tracks a PeerScore per connected peer.
+type Set struct {
+	mu    sync.Mutex
+	peers map[int32]*PeerScore
+}
+
+// NewSet creates an empty peer score set.
+func NewSet() *Set {
+	return &Set{peers: make(map[int32]*PeerScore)}
+}
+
+// Add starts tracking p, returning its score. Calling Add again for a peer
+// that's already tracked just returns the existing score.
+func (s *Set) Add(p *peer.Peer) *PeerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ps, ok := s.peers[p.ID()]; ok {
+		return ps
+	}
+	ps := newPeerScore(p)
+	s.peers[p.ID()] = ps
+	return ps
+}
+
+// Remove stops tracking p.
+func (s *Set) Remove(p *peer.Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, p.ID())
+}
+
+// Get returns p's score, or nil if it isn't tracked.
+func (s *Set) Get(p *peer.Peer) *PeerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peers[p.ID()]
+}
+
+// Best returns the highest-scoring peer whose advertised LastBlock exceeds
+// tipHeight, or nil if there isn't one. Banned peers are never returned.
+// Peers are ranked by measured throughput first (peers with no measurement
+// yet rank behind ones that do), then by advertised height, then by the
+// lowest ban score.
+func (s *Set) Best(tipHeight uint32) *PeerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var best *PeerScore
+	for _, ps := range s.peers {
+		if ps.Banned() {
+			continue
+		}
+		// Compare in signed space first: a peer advertising a non-positive
+		// LastBlock has no real chain to offer, and converting it to uint32
+		// before comparing would wrap it into a huge value that looks like
+		// it exceeds our tip.
+		if ps.LastBlock() <= 0 || uint32(ps.LastBlock()) <= tipHeight {
+			continue
+		}
+		if best == nil || ranksHigher(ps, best) {
+			best = ps
+		}
+	}
+	return best
+}
+
+func ranksHigher(a, b *PeerScore) bool {
+	if at, bt := a.Throughput(), b.Throughput(); at != bt {
+		return at > bt
+	}
+	if a.LastBlock() != b.LastBlock() {
+		return a.LastBlock() > b.LastBlock()
+	}
+	return a.BanScore() < b.BanScore()
+}
@@ -0,0 +1,120 @@
+package peers
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/peer"
+)
+
+func testPeer(t *testing.T, addr string, lastBlock int32) *peer.Peer {
+	t.Helper()
+	p, err := peer.NewOutboundPeer(&peer.Config{}, addr)
+	if err != nil {
+		t.Fatalf("peer.NewOutboundPeer(%q) error: %v", addr, err)
+	}
+	p.UpdateLastBlockHeight(lastBlock)
+	return p
+}
+
+// addDistinct tracks p under a key of its own. Peers that never completed a
+// version handshake all report ID 0, so Add would fold them into one entry.
+func addDistinct(s *Set, p *peer.Peer) *PeerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := newPeerScore(p)
+	s.peers[int32(len(s.peers)+1)] = ps
+	return ps
+}
+
+func TestBestSkipsBannedPeers(t *testing.T) {
+	s := NewSet()
+	p := testPeer(t, "127.0.0.1:8333", 100)
+	ps := s.Add(p)
+	for i := 0; i < 5; i++ {
+		ps.RecordInvalidBlock()
+	}
+	if !ps.Banned() {
+		t.Fatal("peer should be banned after enough invalid-block penalties")
+	}
+	if best := s.Best(0); best != nil {
+		t.Fatalf("Best() = %v, want nil for a set containing only a banned peer", best)
+	}
+}
+
+func TestBestSkipsNonPositiveOrNonAdvancingHeight(t *testing.T) {
+	s := NewSet()
+	behind := addDistinct(s, testPeer(t, "127.0.0.1:8333", 50))
+	negative := addDistinct(s, testPeer(t, "127.0.0.1:8334", -1))
+	_ = behind
+	_ = negative
+
+	if best := s.Best(100); best != nil {
+		t.Fatalf("Best(100) = %v, want nil: no peer advertises a height above 100", best)
+	}
+}
+
+func TestBestPrefersHigherThroughput(t *testing.T) {
+	s := NewSet()
+	slow := addDistinct(s, testPeer(t, "127.0.0.1:8333", 200))
+	fast := addDistinct(s, testPeer(t, "127.0.0.1:8334", 200))
+
+	slow.RecordBlock(10)
+	fast.RecordBlock(1000)
+	// Force both windows to roll over so Throughput() reflects what was
+	// recorded instead of reading back zero.
+	slow.windowStart = slow.windowStart.Add(-throughputWindow)
+	fast.windowStart = fast.windowStart.Add(-throughputWindow)
+	slow.RecordBlock(0)
+	fast.RecordBlock(0)
+
+	best := s.Best(0)
+	if best == nil || best != fast {
+		t.Fatalf("Best() picked the slower peer, want the one with higher throughput")
+	}
+}
+
+func TestBestFallsBackToHeightWhenThroughputTies(t *testing.T) {
+	s := NewSet()
+	higher := addDistinct(s, testPeer(t, "127.0.0.1:8333", 300))
+	addDistinct(s, testPeer(t, "127.0.0.1:8334", 200))
+
+	best := s.Best(0)
+	if best == nil || best != higher {
+		t.Fatal("Best() should prefer the peer advertising the greater height when throughput ties")
+	}
+}
+
+func TestRecordTimeoutAccumulatesBanScore(t *testing.T) {
+	s := NewSet()
+	ps := s.Add(testPeer(t, "127.0.0.1:8333", 100))
+	for i := 0; i < 4; i++ {
+		ps.RecordTimeout()
+	}
+	if ps.Banned() {
+		t.Fatal("4 timeouts should not yet cross the ban threshold")
+	}
+	ps.RecordTimeout()
+	if !ps.Banned() {
+		t.Fatal("5 timeouts should cross the ban threshold")
+	}
+}
+
+func TestAddIsIdempotentPerPeer(t *testing.T) {
+	s := NewSet()
+	p := testPeer(t, "127.0.0.1:8333", 100)
+	first := s.Add(p)
+	second := s.Add(p)
+	if first != second {
+		t.Fatal("Add called twice for the same peer should return the same *PeerScore")
+	}
+}
+
+func TestRemoveStopsTracking(t *testing.T) {
+	s := NewSet()
+	p := testPeer(t, "127.0.0.1:8333", 100)
+	s.Add(p)
+	s.Remove(p)
+	if s.Get(p) != nil {
+		t.Fatal("Get(p) should return nil after Remove")
+	}
+}